@@ -1,28 +1,81 @@
 package iputils
 
 import (
+	"container/list"
+	"encoding/binary"
 	"errors"
+	"math/bits"
 	"net"
 	"unsafe"
 )
 
-// Radix tree node
+// node is a path-compressed (Patricia) trie node, in the style of
+// WireGuard's allowedips: it stores the full prefix it represents in
+// "bits", the length of that prefix in "cidr", and the byte/shift of the
+// bit used to choose between its two children so that choose doesn't have
+// to recompute it on every lookup.
+//
+// vlist/elem thread the node into s.index[value]'s list when value is
+// non-nil, mirroring how allowedips keeps a perPeerElem on each trie
+// entry so a peer's routes can be found and dropped in one pass.
 type node struct {
-	left   *node
-	right  *node
-	parent *node
-	value  interface{}
+	parent     *node
+	child      [2]*node
+	bits       []byte
+	cidr       uint8
+	bitAtByte  uint8
+	bitAtShift uint8
+	value      interface{}
+	vlist      *list.List
+	elem       *list.Element
 }
 
-type IPSet struct {
-	root *node
-	free *node
-	pool []node
+// choose returns which child of n the given key falls under.
+func (n *node) choose(key []byte) byte {
+	return (key[n.bitAtByte] >> n.bitAtShift) & 1
 }
 
-const (
-	START_BYTE = byte(0x80)
-)
+func bitAtByte(cidr uint8) uint8  { return cidr >> 3 }
+func bitAtShift(cidr uint8) uint8 { return 7 - cidr&7 }
+
+// commonBits returns the number of leading bits that ip1 and ip2 share,
+// using bits.LeadingZeros32/64 on big-endian words so it costs a handful
+// of instructions instead of a byte-at-a-time loop.
+func commonBits(ip1, ip2 []byte) uint8 {
+	switch len(ip1) {
+	case net.IPv4len:
+		a := binary.BigEndian.Uint32(ip1)
+		b := binary.BigEndian.Uint32(ip2)
+		return uint8(bits.LeadingZeros32(a ^ b))
+	case net.IPv6len:
+		a := binary.BigEndian.Uint64(ip1[0:8])
+		b := binary.BigEndian.Uint64(ip2[0:8])
+		if x := a ^ b; x != 0 {
+			return uint8(bits.LeadingZeros64(x))
+		}
+		a = binary.BigEndian.Uint64(ip1[8:16])
+		b = binary.BigEndian.Uint64(ip2[8:16])
+		return 64 + uint8(bits.LeadingZeros64(a^b))
+	default:
+		return 0
+	}
+}
+
+// family is one address family's independent trie: its own root and
+// entry count, so a v4 key can never be walked against v6 nodes or vice
+// versa.
+type family struct {
+	root  *node
+	count int
+}
+
+type IPSet struct {
+	v4    family
+	v6    family
+	free  *node
+	pool  []node
+	index map[interface{}]*list.List
+}
 
 var (
 	ErrNodeBusy = errors.New("node is busy")
@@ -34,184 +87,401 @@ var (
 )
 
 func NewSet() *IPSet {
-	set := &IPSet{}
-	set.root = set.newNode()
-	return set
+	return &IPSet{}
 }
 
-func (s *IPSet) insert(key net.IP, mask net.IPMask, value interface{}, overwrite bool) error {
-	if len(key) != len(mask) {
-		return ErrBadIP
+// normalizeIP resolves ip to its 4- or 16-byte form (so a 4-in-6 address
+// from net.ParseIP is treated as v4, not v6) and reports which family it
+// belongs to. bitlen is the candidate mask's Size(), which must agree
+// with the normalized length or the IP and mask are for different
+// families.
+func normalizeIP(ip net.IP, bitlen int) (key net.IP, isV4 bool, err error) {
+	if v4 := ip.To4(); v4 != nil {
+		if bitlen != 8*net.IPv4len {
+			return nil, false, ErrBadIP
+		}
+		return v4, true, nil
+	}
+	v6 := ip.To16()
+	if v6 == nil || bitlen != 8*net.IPv6len {
+		return nil, false, ErrBadIP
 	}
+	return v6, false, nil
+}
 
-	i := 0
-	bitmap := START_BYTE
-	node := s.root
-	next := s.root
+// familyFor normalizes ip and returns the family trie it belongs to.
+func (s *IPSet) familyFor(ip net.IP, bitlen int) (*family, net.IP, error) {
+	key, isV4, err := normalizeIP(ip, bitlen)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isV4 {
+		return &s.v4, key, nil
+	}
+	return &s.v6, key, nil
+}
 
-	for bitmap&mask[i] != 0 {
-		if key[i]&bitmap != 0 {
-			next = node.right
-		} else {
-			next = node.left
-		}
-		if next == nil {
-			break
-		}
+// link threads n into s.index[n.value], creating that value's list on
+// first use. A nil value is never indexed.
+func (s *IPSet) link(n *node) {
+	if n.value == nil {
+		return
+	}
+	if s.index == nil {
+		s.index = make(map[interface{}]*list.List)
+	}
+	l := s.index[n.value]
+	if l == nil {
+		l = list.New()
+		s.index[n.value] = l
+	}
+	n.vlist = l
+	n.elem = l.PushBack(n)
+}
 
-		node = next
+// unlink removes n from whichever value-list it's threaded into, if any,
+// dropping that list from the index once it's empty.
+func (s *IPSet) unlink(n *node) {
+	if n.elem == nil {
+		return
+	}
+	n.vlist.Remove(n.elem)
+	if n.vlist.Len() == 0 {
+		delete(s.index, n.value)
+	}
+	n.vlist, n.elem = nil, nil
+}
 
-		if bitmap >>= 1; bitmap == 0 {
-			if i++; i == len(key) {
-				break
-			}
-			bitmap = START_BYTE
-		}
+// setValue changes n's value, keeping the reverse index in sync.
+func (s *IPSet) setValue(n *node, v interface{}) {
+	s.unlink(n)
+	n.value = v
+	s.link(n)
+}
 
+// newNode allocates (from the freelist or pool) a node holding a copy of
+// key masked down to its first cidr bits, the same prefix a *net.IPNet
+// with that mask would carry.
+func (s *IPSet) newNode(key []byte, cidr uint8, value interface{}) *node {
+	n := s.allocNode()
+	n.bits = append(n.bits, key...)
+	n.cidr = cidr
+	n.bitAtByte = bitAtByte(cidr)
+	n.bitAtShift = bitAtShift(cidr)
+
+	mask := net.CIDRMask(int(cidr), len(key)*8)
+	for i := range n.bits {
+		n.bits[i] &= mask[i]
 	}
 
-	if next != nil {
-		if node.value != nil && !overwrite {
-			return ErrNodeBusy
-		}
-		node.value = value
-		return nil
+	s.setValue(n, value)
+	return n
+}
+
+// newBareNode builds a node exactly like newNode but skips the value
+// reverse index: used where a tree's nodes are never queried by value
+// and linking them would just pin them in s.index forever once they're
+// superseded (see ConcurrentIPSet, whose COW writers clone nodes rather
+// than mutate them in place).
+func (s *IPSet) newBareNode(key []byte, cidr uint8, value interface{}) *node {
+	n := s.allocNode()
+	n.bits = append(n.bits, key...)
+	n.cidr = cidr
+	n.bitAtByte = bitAtByte(cidr)
+	n.bitAtShift = bitAtShift(cidr)
+	n.value = value
+
+	mask := net.CIDRMask(int(cidr), len(key)*8)
+	for i := range n.bits {
+		n.bits[i] &= mask[i]
 	}
+	return n
+}
 
-	for bitmap&mask[i] != 0 {
-		next = s.newNode()
-		next.parent = node
-		if key[i]&bitmap != 0 {
-			node.right = next
-		} else {
-			node.left = next
-		}
-		node = next
-		if bitmap >>= 1; bitmap == 0 {
-			if i++; i == len(key) {
-				break
-			}
-			bitmap = START_BYTE
-		}
+func (s *IPSet) allocNode() *node {
+	if s.free != nil {
+		n := s.free
+		s.free = n.child[0]
+		n.child[0], n.child[1], n.parent, n.value = nil, nil, nil, nil
+		n.vlist, n.elem = nil, nil
+		n.bits = n.bits[:0]
+		return n
 	}
-	node.value = value
 
-	return nil
+	size := len(s.pool)
+	if size == cap(s.pool) {
+		s.pool = make([]node, ALLOC_LEN)[:1]
+		size = 0
+	} else {
+		s.pool = s.pool[:size+1]
+	}
+	return &s.pool[size]
+}
+
+func (s *IPSet) freeNode(n *node) {
+	n.child[0] = s.free
+	n.child[1] = nil
+	n.parent = nil
+	n.value = nil
+	n.vlist, n.elem = nil, nil
+	n.bits = nil
+	s.free = n
 }
 
-func (s *IPSet) delete(key net.IP, mask net.IPMask, sub bool) error {
-	if len(key) != len(mask) {
+func (s *IPSet) replaceChild(fam *family, parent, old, new *node) {
+	if parent == nil {
+		fam.root = new
+		return
+	}
+	if parent.child[0] == old {
+		parent.child[0] = new
+	} else {
+		parent.child[1] = new
+	}
+}
+
+func (s *IPSet) insert(ip net.IP, mask net.IPMask, value interface{}, overwrite bool) error {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
 		return ErrBadIP
 	}
+	fam, key, err := s.familyFor(ip, bitlen)
+	if err != nil {
+		return err
+	}
+	cidr := uint8(ones)
 
-	i := 0
-	bitmap := START_BYTE
-	node := s.root
+	if fam.root == nil {
+		fam.root = s.newNode(key, cidr, value)
+		fam.count++
+		return nil
+	}
 
-	for node != nil && bitmap&mask[i] != 0 {
-		if key[i]&bitmap != 0 {
-			node = node.right
-		} else {
-			node = node.left
-		}
-		if bitmap >>= 1; bitmap == 0 {
-			if i++; i == len(key) {
-				break
+	cur := fam.root
+	for {
+		common := commonBits(cur.bits, key)
+
+		if common >= cur.cidr && cidr == cur.cidr {
+			if cur.value != nil && !overwrite {
+				return ErrNodeBusy
+			}
+			if cur.value == nil {
+				fam.count++
 			}
-			bitmap = START_BYTE
+			s.setValue(cur, value)
+			return nil
 		}
-	}
 
-	if node == nil {
-		return ErrNotFound
-	}
+		if common >= cur.cidr && cidr > cur.cidr {
+			// key agrees with everything cur represents; descend into
+			// (or attach under) the child on the branching bit.
+			next := cur.child[cur.choose(key)]
+			if next == nil {
+				newNode := s.newNode(key, cidr, value)
+				newNode.parent = cur
+				cur.child[cur.choose(key)] = newNode
+				fam.count++
+				return nil
+			}
+			cur = next
+			continue
+		}
 
-	if !sub && (node.right != nil || node.left != nil) {
-		// trim value
-		if node.value != nil {
-			node.value = nil
-			return nil
+		// cur and key diverge before cur.cidr is reached, or the new
+		// prefix is shorter than cur's: either attach cur as a child of
+		// the new entry, or split out an intermediate node holding the
+		// bits they still share.
+		newCIDR := cidr
+		if common < newCIDR {
+			newCIDR = common
 		}
-		return ErrNotFound
-	}
 
-	// trim leaf
-	for {
-		if node.parent.right == node {
-			node.parent.right = nil
+		newEntry := s.newNode(key, cidr, value)
+		parent := cur.parent
+		var splice *node
+
+		if newCIDR == cidr {
+			// new prefix is an ancestor of (or equal to, handled above)
+			// cur: cur becomes its child.
+			splice = newEntry
+			splice.child[splice.choose(cur.bits)] = cur
+			cur.parent = splice
 		} else {
-			node.parent.left = nil
+			// common ground falls short of both prefixes: synthesize an
+			// intermediate holding just the shared bits.
+			splice = s.newNode(key, newCIDR, nil)
+			splice.child[splice.choose(cur.bits)] = cur
+			splice.child[splice.choose(key)] = newEntry
+			cur.parent = splice
+			newEntry.parent = splice
 		}
-		// free
-		node.right = s.free
-		s.free = node
 
-		// move to parent
-		node = node.parent
-		if node.right != nil || node.left != nil || node.value != nil {
+		splice.parent = parent
+		s.replaceChild(fam, parent, cur, splice)
+		fam.count++
+		return nil
+	}
+}
+
+func (s *IPSet) delete(ip net.IP, mask net.IPMask, sub bool) error {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
+		return ErrBadIP
+	}
+	fam, key, err := s.familyFor(ip, bitlen)
+	if err != nil {
+		return err
+	}
+	cidr := uint8(ones)
+
+	node := fam.root
+	for node != nil {
+		if common := commonBits(node.bits, key); common < node.cidr && common < cidr {
+			node = nil
 			break
 		}
-		if node.parent == nil {
+		if node.cidr >= cidr {
 			break
 		}
+		node = node.child[node.choose(key)]
 	}
 
-	return nil
+	switch {
+	case node == nil:
+		return ErrNotFound
+	case node.cidr == cidr:
+		if node.value == nil {
+			return ErrNotFound
+		}
+		return s.deleteNode(fam, node, sub)
+	case sub:
+		// node sits strictly under the target prefix and no node ever
+		// materialized exactly at cidr (no split happened to land there):
+		// excise node, and everything below it, wholesale.
+		s.excise(fam, node)
+		return nil
+	default:
+		return ErrNotFound
+	}
 }
 
-func (s *IPSet) find(key net.IP, mask net.IPMask) (value interface{}, err error) {
-	if len(key) != len(mask) {
-		return nil, ErrBadIP
+// deleteNode clears n's value. If sub is true, it also discards every
+// more-specific entry nested under n (the "subtract a whole subtree"
+// behavior Sub exposes); otherwise, if n still branches (has both
+// children), it's left in
+// place as a bare intermediate node. Either way, n itself then collapses
+// (along with any single-child ancestors that become bare as a result)
+// out of the trie. It's split out of delete so RemoveByValue can drop a
+// node it already has a pointer to without re-walking the trie by key.
+func (s *IPSet) deleteNode(fam *family, n *node, sub bool) error {
+	if n.value != nil {
+		fam.count--
+	}
+	s.setValue(n, nil)
+
+	if sub {
+		s.freeSubtree(fam, n.child[0])
+		s.freeSubtree(fam, n.child[1])
+		n.child[0], n.child[1] = nil, nil
+	} else if n.child[0] != nil && n.child[1] != nil {
+		return nil
 	}
 
-	i := 0
-	bitmap := START_BYTE
-	node := s.root
+	s.collapseFrom(fam, n)
+	return nil
+}
 
-	for node != nil {
-		if node.value != nil {
-			value = node.value
-		}
-		if key[i]&bitmap != 0 {
-			node = node.right
-		} else {
-			node = node.left
-		}
-		if mask[i]&bitmap == 0 {
-			break
-		}
-		if bitmap >>= 1; bitmap == 0 {
-			i, bitmap = i+1, START_BYTE
-			if i >= len(key) {
-				if node != nil {
-					value = node.value
-				}
-				break
+// excise removes n, and everything under it, from the trie wholesale,
+// decrementing fam.count for every descendant (including n itself) that
+// still carried a value, then collapses n's former parent if that left
+// it bare. Unlike deleteNode, it never leaves n behind as an intermediate
+// node: it's for Sub landing strictly inside an existing node's prefix,
+// where no split ever materialized a node exactly at the target cidr, so
+// the whole node standing in for that depth has to go.
+func (s *IPSet) excise(fam *family, n *node) {
+	parent := n.parent
+	s.replaceChild(fam, parent, n, nil)
+	s.freeSubtree(fam, n)
+	if parent != nil && parent.value == nil {
+		s.collapseFrom(fam, parent)
+	}
+}
+
+// collapseFrom removes n if it's a bare leaf, or pulls its single child
+// up into its place if it's a bare node with exactly one, then keeps
+// walking up through ancestors left bare by that, stopping as soon as a
+// node still branches or still carries a value.
+func (s *IPSet) collapseFrom(fam *family, n *node) {
+	for {
+		parent := n.parent
+		left, right := n.child[0], n.child[1]
+
+		switch {
+		case left != nil && right != nil:
+			// still branches: keep it around as a bare intermediate node.
+			return
+		case left != nil || right != nil:
+			// exactly one child: pull it up in n's place.
+			child := left
+			if child == nil {
+				child = right
 			}
+			child.parent = parent
+			s.replaceChild(fam, parent, n, child)
+			s.freeNode(n)
+			return
+		default:
+			// leaf: drop it, then see if that left the parent collapsible.
+			s.replaceChild(fam, parent, n, nil)
+			s.freeNode(n)
+			if parent == nil || parent.value != nil {
+				return
+			}
+			n = parent
 		}
 	}
-	return value, nil
 }
 
-func (s *IPSet) newNode() (p *node) {
-	if s.free != nil {
-		p = s.free
-		s.free = s.free.right
-		p.right = nil
-		p.parent = nil
-		p.left = nil
-		p.value = nil
-		return p
+// freeSubtree unlinks and frees every node under (and including) n,
+// which may be nil, decrementing fam.count for each one that still
+// carried a value. Used by deleteNode and excise to implement Sub's
+// "remove this prefix and everything more specific than it" semantics.
+func (s *IPSet) freeSubtree(fam *family, n *node) {
+	if n == nil {
+		return
+	}
+	s.freeSubtree(fam, n.child[0])
+	s.freeSubtree(fam, n.child[1])
+	if n.value != nil {
+		fam.count--
 	}
+	s.unlink(n)
+	s.freeNode(n)
+}
 
-	size := len(s.pool)
-	if size == cap(s.pool) {
-		s.pool = make([]node, ALLOC_LEN)[:1]
-		size = 0
-	} else {
-		s.pool = s.pool[:size+1]
+func (s *IPSet) find(ip net.IP, mask net.IPMask) (interface{}, error) {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
+		return nil, ErrBadIP
 	}
-	return &(s.pool[size])
+	fam, key, err := s.familyFor(ip, bitlen)
+	if err != nil {
+		return nil, err
+	}
+	cidr := uint8(ones)
+
+	var value interface{}
+	node := fam.root
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, key) >= node.cidr {
+		if node.value != nil {
+			value = node.value
+		}
+		if node.cidr == cidr {
+			break
+		}
+		node = node.child[node.choose(key)]
+	}
+	return value, nil
 }
 
 func (s *IPSet) Add(cidr *net.IPNet, val interface{}) error {
@@ -234,9 +504,79 @@ func (s *IPSet) Get(cidr *net.IPNet) (interface{}, error) {
 	return s.find(cidr.IP, cidr.Mask)
 }
 
+// GetByIP normalizes ip the same way Add/Set do, so a 4-in-6 address
+// returned by net.ParseIP is looked up in the v4 trie rather than
+// falling into the v6 one just because len(ip) == 16.
 func (s *IPSet) GetByIP(ip net.IP) (interface{}, error) {
-	if len(ip) == net.IPv4len {
-		return s.find(ip, MASK_32)
+	if v4 := ip.To4(); v4 != nil {
+		return s.find(v4, MASK_32)
 	}
 	return s.find(ip, MASK_128)
 }
+
+// Len4 returns the number of IPv4 entries.
+func (s *IPSet) Len4() int { return s.v4.count }
+
+// Len6 returns the number of IPv6 entries.
+func (s *IPSet) Len6() int { return s.v6.count }
+
+// Walk visits every populated prefix, IPv4 entries first then IPv6, in
+// ascending address order within each family, calling fn with each
+// one's CIDR and value. It stops early if fn returns false.
+func (s *IPSet) Walk(fn func(cidr *net.IPNet, val interface{}) bool) {
+	if !walkNode(s.v4.root, fn) {
+		return
+	}
+	walkNode(s.v6.root, fn)
+}
+
+// Walk4 visits only the IPv4 entries, in ascending address order.
+func (s *IPSet) Walk4(fn func(cidr *net.IPNet, val interface{}) bool) {
+	walkNode(s.v4.root, fn)
+}
+
+// Walk6 visits only the IPv6 entries, in ascending address order.
+func (s *IPSet) Walk6(fn func(cidr *net.IPNet, val interface{}) bool) {
+	walkNode(s.v6.root, fn)
+}
+
+func walkNode(n *node, fn func(*net.IPNet, interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.value != nil {
+		ip := make(net.IP, len(n.bits))
+		copy(ip, n.bits)
+		cidr := &net.IPNet{IP: ip, Mask: net.CIDRMask(int(n.cidr), len(ip)*8)}
+		if !fn(cidr, n.value) {
+			return false
+		}
+	}
+	return walkNode(n.child[0], fn) && walkNode(n.child[1], fn)
+}
+
+// RemoveByValue deletes every entry whose value equals val, across both
+// families, returning the count removed. It runs in O(matches) by
+// following the reverse index built up by setValue rather than walking
+// the whole trie, the same trick allowedips uses to let a WireGuard
+// peer's routes all be dropped in one pass.
+func (s *IPSet) RemoveByValue(val interface{}) int {
+	l := s.index[val]
+	if l == nil {
+		return 0
+	}
+
+	removed := 0
+	for e := l.Front(); e != nil; {
+		next := e.Next()
+		n := e.Value.(*node)
+		fam := &s.v6
+		if len(n.bits) == net.IPv4len {
+			fam = &s.v4
+		}
+		s.deleteNode(fam, n, false)
+		removed++
+		e = next
+	}
+	return removed
+}
@@ -0,0 +1,314 @@
+package iputils
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// concurrentSnapshot is the immutable view readers see: a v4 and a v6
+// root published together, so a reader never pairs a v4 trie from one
+// generation with a v6 trie from another.
+type concurrentSnapshot struct {
+	v4 *node
+	v6 *node
+}
+
+// ConcurrentIPSet is an IPSet variant for workloads where lookup QPS
+// dwarfs the update rate, such as a router's packet path: GetByIP/Get
+// take no lock at all and simply walk whatever snapshot was current
+// when they started, while Add/Set/Sub/Remove serialize on a writer
+// mutex and publish a new snapshot via atomic.Pointer. A write only
+// path-copies the nodes from the root down to the one it changes;
+// everything else in the tree is shared, untouched, with the previous
+// snapshot, so a reader already mid-traversal off the old root is
+// never affected by a write in flight.
+//
+// Known limitation: nodes a write clones away are not recycled into
+// IPSet's node pool/freelist. Pooling them safely would require knowing
+// when every reader that might still be walking the superseded snapshot
+// has finished with it (tracking reader epochs/refcounts per
+// generation), which this implementation does not do. Superseded nodes
+// are instead simply left for the garbage collector. On a write-heavy
+// workload this means more GC pressure than IPSet's pooled allocator,
+// which is the tradeoff for keeping reads lock-free and allocation-free
+// on the read path.
+type ConcurrentIPSet struct {
+	cur atomic.Pointer[concurrentSnapshot]
+	mu  sync.Mutex
+	set IPSet
+}
+
+func NewConcurrentSet() *ConcurrentIPSet {
+	s := &ConcurrentIPSet{}
+	s.cur.Store(&concurrentSnapshot{})
+	return s
+}
+
+// snapshot returns the current published view, tolerating a zero-value
+// ConcurrentIPSet the same way a zero-value IPSet tolerates a nil root.
+func (s *ConcurrentIPSet) snapshot() *concurrentSnapshot {
+	if snap := s.cur.Load(); snap != nil {
+		return snap
+	}
+	return &concurrentSnapshot{}
+}
+
+func (s *ConcurrentIPSet) cloneNode(n *node) *node {
+	c := s.set.allocNode()
+	c.bits = append(c.bits, n.bits...)
+	c.cidr = n.cidr
+	c.bitAtByte = n.bitAtByte
+	c.bitAtShift = n.bitAtShift
+	c.value = n.value
+	c.child = n.child
+	return c
+}
+
+// cowInsert returns a new subtree reflecting the insertion of
+// (key, cidr, value) under n, cloning only the nodes on the path from n
+// down to the change.
+func (s *ConcurrentIPSet) cowInsert(n *node, key []byte, cidr uint8, value interface{}, overwrite bool) (*node, error) {
+	if n == nil {
+		return s.set.newBareNode(key, cidr, value), nil
+	}
+
+	common := commonBits(n.bits, key)
+
+	switch {
+	case common >= n.cidr && cidr == n.cidr:
+		if n.value != nil && !overwrite {
+			return nil, ErrNodeBusy
+		}
+		clone := s.cloneNode(n)
+		clone.value = value
+		return clone, nil
+
+	case common >= n.cidr && cidr > n.cidr:
+		bit := n.choose(key)
+		child, err := s.cowInsert(n.child[bit], key, cidr, value, overwrite)
+		if err != nil {
+			return nil, err
+		}
+		clone := s.cloneNode(n)
+		clone.child[bit] = child
+		return clone, nil
+
+	default:
+		// n and key diverge, or the new prefix is shorter than n's: n
+		// itself is untouched and gets shared by both the old and new
+		// snapshot, just reparented under a newly built splice.
+		newCIDR := cidr
+		if common < newCIDR {
+			newCIDR = common
+		}
+		newEntry := s.set.newBareNode(key, cidr, value)
+
+		if newCIDR == cidr {
+			splice := newEntry
+			splice.child[splice.choose(n.bits)] = n
+			return splice, nil
+		}
+		splice := s.set.newBareNode(key, newCIDR, nil)
+		splice.child[splice.choose(n.bits)] = n
+		splice.child[splice.choose(key)] = newEntry
+		return splice, nil
+	}
+}
+
+// cowDelete returns a new subtree for n with the entry at (key, cidr)
+// removed (nil if n is now empty), or ErrNotFound if it doesn't exist.
+func (s *ConcurrentIPSet) cowDelete(n *node, key []byte, cidr uint8, sub bool) (*node, error) {
+	if n == nil {
+		return nil, ErrNotFound
+	}
+	if common := commonBits(n.bits, key); common < n.cidr && common < cidr {
+		return nil, ErrNotFound
+	}
+
+	if n.cidr == cidr {
+		if n.value == nil {
+			return nil, ErrNotFound
+		}
+		if sub {
+			// discard n and everything more specific than it.
+			return nil, nil
+		}
+		switch left, right := n.child[0], n.child[1]; {
+		case left != nil && right != nil:
+			clone := s.cloneNode(n)
+			clone.value = nil
+			return clone, nil
+		case left != nil:
+			return left, nil
+		case right != nil:
+			return right, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	if n.cidr > cidr {
+		// n sits strictly under the target prefix and no node ever
+		// materialized exactly at cidr (no split happened to land there).
+		// Only Sub can act on that: discard n, and everything under it,
+		// wholesale.
+		if !sub {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	}
+
+	bit := n.choose(key)
+	child, err := s.cowDelete(n.child[bit], key, cidr, sub)
+	if err != nil {
+		return nil, err
+	}
+	other := n.child[1-bit]
+
+	if n.value != nil {
+		clone := s.cloneNode(n)
+		clone.child[bit] = child
+		return clone, nil
+	}
+	switch {
+	case child != nil && other != nil:
+		clone := s.cloneNode(n)
+		clone.child[bit] = child
+		return clone, nil
+	case child != nil:
+		return child, nil
+	case other != nil:
+		return other, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *ConcurrentIPSet) insert(ip net.IP, mask net.IPMask, value interface{}, overwrite bool) error {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
+		return ErrBadIP
+	}
+	key, isV4, err := normalizeIP(ip, bitlen)
+	if err != nil {
+		return err
+	}
+	cidr := uint8(ones)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.snapshot()
+	root := old.v6
+	if isV4 {
+		root = old.v4
+	}
+	newRoot, err := s.cowInsert(root, key, cidr, value, overwrite)
+	if err != nil {
+		return err
+	}
+
+	next := *old
+	if isV4 {
+		next.v4 = newRoot
+	} else {
+		next.v6 = newRoot
+	}
+	s.cur.Store(&next)
+	return nil
+}
+
+func (s *ConcurrentIPSet) delete(ip net.IP, mask net.IPMask, sub bool) error {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
+		return ErrBadIP
+	}
+	key, isV4, err := normalizeIP(ip, bitlen)
+	if err != nil {
+		return err
+	}
+	cidr := uint8(ones)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.snapshot()
+	root := old.v6
+	if isV4 {
+		root = old.v4
+	}
+	newRoot, err := s.cowDelete(root, key, cidr, sub)
+	if err != nil {
+		return err
+	}
+
+	next := *old
+	if isV4 {
+		next.v4 = newRoot
+	} else {
+		next.v6 = newRoot
+	}
+	s.cur.Store(&next)
+	return nil
+}
+
+// find is the zero-lock read path: it loads whatever snapshot is
+// current and walks it exactly like IPSet.find, without ever touching
+// s.mu.
+func (s *ConcurrentIPSet) find(ip net.IP, mask net.IPMask) (interface{}, error) {
+	ones, bitlen := mask.Size()
+	if bitlen == 0 {
+		return nil, ErrBadIP
+	}
+	key, isV4, err := normalizeIP(ip, bitlen)
+	if err != nil {
+		return nil, err
+	}
+	cidr := uint8(ones)
+
+	snap := s.snapshot()
+	n := snap.v6
+	if isV4 {
+		n = snap.v4
+	}
+
+	var value interface{}
+	for n != nil && n.cidr <= cidr && commonBits(n.bits, key) >= n.cidr {
+		if n.value != nil {
+			value = n.value
+		}
+		if n.cidr == cidr {
+			break
+		}
+		n = n.child[n.choose(key)]
+	}
+	return value, nil
+}
+
+func (s *ConcurrentIPSet) Add(cidr *net.IPNet, val interface{}) error {
+	return s.insert(cidr.IP, cidr.Mask, val, false)
+}
+
+func (s *ConcurrentIPSet) Set(cidr *net.IPNet, val interface{}) error {
+	return s.insert(cidr.IP, cidr.Mask, val, true)
+}
+
+func (s *ConcurrentIPSet) Sub(cidr *net.IPNet) error {
+	return s.delete(cidr.IP, cidr.Mask, true)
+}
+
+func (s *ConcurrentIPSet) Remove(cidr *net.IPNet) error {
+	return s.delete(cidr.IP, cidr.Mask, false)
+}
+
+func (s *ConcurrentIPSet) Get(cidr *net.IPNet) (interface{}, error) {
+	return s.find(cidr.IP, cidr.Mask)
+}
+
+func (s *ConcurrentIPSet) GetByIP(ip net.IP) (interface{}, error) {
+	if v4 := ip.To4(); v4 != nil {
+		return s.find(v4, MASK_32)
+	}
+	return s.find(ip, MASK_128)
+}
@@ -0,0 +1,100 @@
+package iputils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConcurrentIPSetBasic(t *testing.T) {
+	s := NewConcurrentSet()
+	if err := s.Add(mustCIDR(t, "10.0.0.0/8"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(mustCIDR(t, "10.0.1.0/24"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get(mustCIDR(t, "10.0.1.0/24")); err != nil || v != "b" {
+		t.Fatalf("Get(10.0.1.0/24) = %v, %v", v, err)
+	}
+	if v, err := s.GetByIP(net.ParseIP("10.0.2.1")); err != nil || v != "a" {
+		t.Fatalf("GetByIP(10.0.2.1) = %v, %v", v, err)
+	}
+
+	if err := s.Sub(mustCIDR(t, "10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get(mustCIDR(t, "10.0.1.0/24")); err != nil || v != nil {
+		t.Fatalf("10.0.1.0/24 survived Sub(10.0.0.0/8): %v, %v", v, err)
+	}
+}
+
+// TestConcurrentIPSetSubMidTrie mirrors TestIPSetSubMidTrie: Sub landing
+// strictly between two existing node depths, with no node ever
+// materialized exactly at the target cidr, has to excise the nested node
+// wholesale rather than returning ErrNotFound.
+func TestConcurrentIPSetSubMidTrie(t *testing.T) {
+	s := NewConcurrentSet()
+	if err := s.Add(mustCIDR(t, "10.0.0.0/8"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(mustCIDR(t, "10.0.0.0/16"), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Sub(mustCIDR(t, "10.0.0.0/12")); err != nil {
+		t.Fatalf("Sub(10.0.0.0/12) = %v", err)
+	}
+	if v, err := s.Get(mustCIDR(t, "10.0.0.0/16")); err != nil || v == "b" {
+		t.Fatalf("10.0.0.0/16 still resolves to b after Sub(10.0.0.0/12): %v, %v", v, err)
+	}
+	if v, err := s.Get(mustCIDR(t, "10.0.0.0/8")); err != nil || v != "a" {
+		t.Fatalf("Sub(10.0.0.0/12) touched 10.0.0.0/8: %v, %v", v, err)
+	}
+}
+
+// TestConcurrentIPSetNoIndexLeak guards against superseded clones staying
+// pinned in the underlying IPSet's private value index forever: every
+// write in ConcurrentIPSet goes through s.set's node constructor purely
+// for allocation, and must never thread a node into s.set.index, since
+// nothing ever unlinks a clone that a later write supersedes.
+func TestConcurrentIPSetNoIndexLeak(t *testing.T) {
+	s := NewConcurrentSet()
+	base := net.ParseIP("10.0.0.0").To4()
+	for i := 0; i < 2000; i++ {
+		ip := make(net.IP, 4)
+		copy(ip, base)
+		ip[2] = byte(i >> 8)
+		ip[3] = byte(i)
+		n := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		if err := s.Set(n, i); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set(n, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(s.set.index); got != 0 {
+		t.Fatalf("s.set.index has %d entries, want 0 (superseded clones leaking)", got)
+	}
+}
+
+func TestConcurrentIPSetReaderSeesConsistentSnapshot(t *testing.T) {
+	s := NewConcurrentSet()
+	if err := s.Add(mustCIDR(t, "10.0.0.0/8"), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapBefore := s.snapshot()
+	if err := s.Add(mustCIDR(t, "10.1.0.0/16"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if snapBefore == s.snapshot() {
+		t.Fatalf("write did not publish a new snapshot")
+	}
+	if old := snapBefore.v4; old == nil || old.value != "a" || old.child[0] != nil || old.child[1] != nil {
+		t.Fatalf("write modified the snapshot a reader loaded before it")
+	}
+	if v, err := s.find(net.ParseIP("10.1.0.1"), net.CIDRMask(32, 32)); err != nil || v != "b" {
+		t.Fatalf("find after write = %v, %v", v, err)
+	}
+}
@@ -0,0 +1,113 @@
+package iputils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// AddCIDR parses cidr (e.g. "10.0.0.0/8" or "fd00::/8") and calls Add.
+func (s *IPSet) AddCIDR(cidr string, val interface{}) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return s.Add(n, val)
+}
+
+// RemoveCIDR parses cidr and calls Remove.
+func (s *IPSet) RemoveCIDR(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return s.Remove(n)
+}
+
+// GetCIDR parses cidr and calls Get.
+func (s *IPSet) GetCIDR(cidr string) (interface{}, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(n)
+}
+
+// GetByIPString parses addr and calls GetByIP.
+func (s *IPSet) GetByIPString(addr string) (interface{}, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, ErrBadIP
+	}
+	return s.GetByIP(ip)
+}
+
+// LoadFromReader bulk-loads routes from r, one per line (e.g. an
+// MRT-derived dump or a firewall list), using parse to turn each
+// non-blank line into a (*net.IPNet, value) pair, streaming line by line
+// rather than buffering the whole input so peak memory stays flat
+// regardless of file size. A line parse or Add failure is recorded with
+// its line number and the loader moves on to the next line, so callers
+// can load what's good from a file with a few bad entries and inspect
+// the returned error for what to skip or log.
+//
+// If r also implements io.Seeker (a *os.File, *bytes.Reader, ...), it's
+// counted in a cheap first pass and rewound before the real one, so the
+// node pool can be pre-sized in one shot instead of growing it
+// ALLOC_LEN nodes at a time; a plain io.Reader is loaded in a single
+// streamed pass with no pre-sizing.
+func (s *IPSet) LoadFromReader(r io.Reader, parse func(line string) (*net.IPNet, interface{}, error)) (int, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		count, err := countNonBlankLines(r)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if len(s.pool) == 0 && s.free == nil && count > 0 {
+			s.pool = make([]node, 0, count)
+		}
+	}
+
+	var errs []error
+	n, lineNo := 0, 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		cidr, val, err := parse(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %q: %w", lineNo, line, err))
+			continue
+		}
+		if err := s.Add(cidr, val); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %q: %w", lineNo, line, err))
+			continue
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return n, errors.Join(errs...)
+}
+
+// countNonBlankLines counts r's non-blank lines without retaining them,
+// for LoadFromReader's optional pre-sizing pass over a seekable source.
+func countNonBlankLines(r io.Reader) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
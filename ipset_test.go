@@ -0,0 +1,260 @@
+package iputils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return n
+}
+
+func TestIPSetSplitAndCollapse(t *testing.T) {
+	s := NewSet()
+	if err := s.AddCIDR("10.0.0.0/8", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.128.0.0/9", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.GetCIDR("10.0.0.0/8"); err != nil || v != "a" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if v, err := s.GetCIDR("10.128.0.0/9"); err != nil || v != "b" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if got, want := s.Len4(), 2; got != want {
+		t.Fatalf("Len4() = %d, want %d", got, want)
+	}
+
+	if err := s.RemoveCIDR("10.128.0.0/9"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Len4(), 1; got != want {
+		t.Fatalf("Len4() after remove = %d, want %d", got, want)
+	}
+	if v, err := s.GetByIPString("10.0.1.1"); err != nil || v != "a" {
+		t.Fatalf("GetByIPString after collapse = %v, %v", v, err)
+	}
+}
+
+func TestIPSetRemoveKeepsSubtree(t *testing.T) {
+	s := NewSet()
+	if err := s.AddCIDR("10.0.0.0/8", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.0.1.0/24", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RemoveCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.GetCIDR("10.0.1.0/24"); err != nil || v != "b" {
+		t.Fatalf("Remove() must leave more-specific entries alone, got %v, %v", v, err)
+	}
+	if v, err := s.GetCIDR("10.0.0.0/8"); err != nil || v != nil {
+		t.Fatalf("GetCIDR(10.0.0.0/8) after Remove = %v, %v, want nil value", v, err)
+	}
+}
+
+func TestIPSetSubRemovesSubtree(t *testing.T) {
+	s := NewSet()
+	if err := s.AddCIDR("10.0.0.0/8", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.0.1.0/24", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.1.0.0/16", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	n := mustCIDR(t, "10.0.0.0/8")
+	if err := s.Sub(n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Len4(), 0; got != want {
+		t.Fatalf("Len4() after Sub = %d, want %d", got, want)
+	}
+	if v, err := s.GetCIDR("10.0.1.0/24"); err != nil || v != nil {
+		t.Fatalf("10.0.1.0/24 survived Sub(10.0.0.0/8): %v, %v", v, err)
+	}
+	if v, err := s.GetCIDR("10.1.0.0/16"); err != nil || v != nil {
+		t.Fatalf("10.1.0.0/16 survived Sub(10.0.0.0/8): %v, %v", v, err)
+	}
+}
+
+// TestIPSetSubMidTrie covers Sub landing strictly between two existing
+// node depths, where no split ever materialized a node exactly at the
+// target cidr: 10.0.0.0/12 sits between the /8 and /16 entries below, so
+// the walk has to stop at the /16 node (the first one whose cidr is at
+// or past 12) and excise it wholesale rather than returning ErrNotFound.
+func TestIPSetSubMidTrie(t *testing.T) {
+	s := NewSet()
+	if err := s.AddCIDR("10.0.0.0/8", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.0.0.0/16", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Sub(mustCIDR(t, "10.0.0.0/12")); err != nil {
+		t.Fatalf("Sub(10.0.0.0/12) = %v", err)
+	}
+	if v, err := s.GetCIDR("10.0.0.0/16"); err != nil || v == "b" {
+		t.Fatalf("10.0.0.0/16 still resolves to b after Sub(10.0.0.0/12): %v, %v", v, err)
+	}
+	if v, err := s.GetCIDR("10.0.0.0/8"); err != nil || v != "a" {
+		t.Fatalf("Sub(10.0.0.0/12) touched 10.0.0.0/8: %v, %v", v, err)
+	}
+}
+
+func TestIPSet4in6Normalization(t *testing.T) {
+	s := NewSet()
+	n := &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}
+	if err := s.Add(n, "v4"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Len4(), 1; got != want {
+		t.Fatalf("4-in-6 insert landed in the wrong family: Len4() = %d, want %d", got, want)
+	}
+	if got := s.Len6(); got != 0 {
+		t.Fatalf("4-in-6 insert landed in the wrong family: Len6() = %d, want 0", got)
+	}
+	if v, err := s.GetByIPString("10.0.0.1"); err != nil || v != "v4" {
+		t.Fatalf("GetByIPString(10.0.0.1) = %v, %v", v, err)
+	}
+}
+
+func TestIPSetWalkOrder(t *testing.T) {
+	s := NewSet()
+	for _, cidr := range []string{"10.1.0.0/16", "10.0.0.0/8", "10.2.0.0/16"} {
+		if err := s.AddCIDR(cidr, cidr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []string
+	s.Walk4(func(n *net.IPNet, val interface{}) bool {
+		seen = append(seen, val.(string))
+		return true
+	})
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16"}
+	if len(seen) != len(want) {
+		t.Fatalf("Walk4 visited %v, want %v", seen, want)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("Walk4 visited %v, want %v", seen, want)
+		}
+	}
+}
+
+func TestIPSetRemoveByValue(t *testing.T) {
+	s := NewSet()
+	if err := s.AddCIDR("10.0.0.0/8", "peer1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.1.0.0/16", "peer1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("fd00::/8", "peer1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddCIDR("10.2.0.0/16", "peer2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.RemoveByValue("peer1"), 3; got != want {
+		t.Fatalf("RemoveByValue(peer1) = %d, want %d", got, want)
+	}
+	if _, err := s.GetCIDR("10.2.0.0/16"); err != nil {
+		t.Fatalf("RemoveByValue(peer1) touched peer2's entry: %v", err)
+	}
+	if got := s.RemoveByValue("peer1"); got != 0 {
+		t.Fatalf("RemoveByValue(peer1) second call = %d, want 0", got)
+	}
+}
+
+func TestIPSetSetOverwrite(t *testing.T) {
+	s := NewSet()
+	n := mustCIDR(t, "10.0.0.0/8")
+	if err := s.Add(n, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(n, "b"); err != ErrNodeBusy {
+		t.Fatalf("Add over existing entry = %v, want ErrNodeBusy", err)
+	}
+	if err := s.Set(n, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get(n); err != nil || v != "b" {
+		t.Fatalf("Get() after Set() = %v, %v", v, err)
+	}
+}
+
+func TestIPSetLoadFromReader(t *testing.T) {
+	s := NewSet()
+	data := "10.0.0.0/8 a\n10.1.0.0/16 b\n\nbad line\n"
+	n, err := s.LoadFromReader(strings.NewReader(data), func(line string) (*net.IPNet, interface{}, error) {
+		var cidr, val string
+		_, scanErr := fmt.Sscan(line, &cidr, &val)
+		if scanErr != nil {
+			return nil, nil, scanErr
+		}
+		_, ipNet, parseErr := net.ParseCIDR(cidr)
+		if parseErr != nil {
+			return nil, nil, parseErr
+		}
+		return ipNet, val, nil
+	})
+	if n != 2 {
+		t.Fatalf("LoadFromReader loaded %d routes, want 2 (err: %v)", n, err)
+	}
+	if err == nil {
+		t.Fatalf("LoadFromReader should have reported the bad line")
+	}
+	if v, getErr := s.GetCIDR("10.1.0.0/16"); getErr != nil || v != "b" {
+		t.Fatalf("GetCIDR(10.1.0.0/16) = %v, %v", v, getErr)
+	}
+}
+
+// nonSeekingReader wraps an io.Reader without exposing io.Seeker, so
+// TestIPSetLoadFromReaderStreaming exercises LoadFromReader's plain
+// streaming path rather than the seekable pre-sizing one.
+type nonSeekingReader struct{ io.Reader }
+
+func TestIPSetLoadFromReaderStreaming(t *testing.T) {
+	s := NewSet()
+	data := "10.0.0.0/8 a\n10.1.0.0/16 b\n\nbad line\n"
+	n, err := s.LoadFromReader(nonSeekingReader{strings.NewReader(data)}, func(line string) (*net.IPNet, interface{}, error) {
+		var cidr, val string
+		_, scanErr := fmt.Sscan(line, &cidr, &val)
+		if scanErr != nil {
+			return nil, nil, scanErr
+		}
+		_, ipNet, parseErr := net.ParseCIDR(cidr)
+		if parseErr != nil {
+			return nil, nil, parseErr
+		}
+		return ipNet, val, nil
+	})
+	if n != 2 {
+		t.Fatalf("LoadFromReader loaded %d routes, want 2 (err: %v)", n, err)
+	}
+	if err == nil {
+		t.Fatalf("LoadFromReader should have reported the bad line")
+	}
+	if v, getErr := s.GetCIDR("10.0.0.0/8"); getErr != nil || v != "a" {
+		t.Fatalf("GetCIDR(10.0.0.0/8) = %v, %v", v, getErr)
+	}
+}
@@ -0,0 +1,229 @@
+package iputils
+
+import (
+	"math/bits"
+	"net"
+)
+
+// stride512 is a 512-bit set, one bit per baseIdx slot of a single
+// 8-bit stride (see baseIdx). It supports Rank, a popcount-prefix-sum
+// that maps a set bit to its position in a node's compact value slice,
+// so a stride with k routes costs O(k) words of value storage instead
+// of a dense 512-entry array.
+type stride512 [8]uint64
+
+func (b *stride512) test(i int) bool { return b[i>>6]&(1<<uint(i&63)) != 0 }
+func (b *stride512) set(i int)       { b[i>>6] |= 1 << uint(i&63) }
+func (b *stride512) clear(i int)     { b[i>>6] &^= 1 << uint(i&63) }
+
+// rank counts the set bits at positions below i, which is exactly the
+// index that bit i occupies (or would occupy) in the compact value slice.
+func (b *stride512) rank(i int) int {
+	n := 0
+	word := i >> 6
+	for w := 0; w < word; w++ {
+		n += bits.OnesCount64(b[w])
+	}
+	n += bits.OnesCount64(b[word] & (1<<uint(i&63) - 1))
+	return n
+}
+
+// baseIdx encodes a prefix of length pfxLen (0..8) terminating in this
+// stride as a single slot in a complete binary tree over the stride's
+// 8 bits: 1 at the root (pfxLen 0), 256..511 at the leaves (pfxLen 8).
+// Halving a child's index walks up to its parent prefix, one bit
+// shorter, which is what makes the LPM walk in lookupStride cheap.
+func baseIdx(octet byte, pfxLen uint8) int {
+	return 1<<pfxLen | int(octet>>(8-pfxLen))
+}
+
+// tableNode is one stride (8 bits) of a BART-style multibit routing
+// table: up to 256 child pointers for the next stride, plus a compact
+// set of the prefixes of length 0..8 that terminate inside this stride.
+type tableNode struct {
+	prefixes stride512
+	values   []interface{}
+	child    [256]*tableNode
+}
+
+func (n *tableNode) setPrefix(idx int, val interface{}) {
+	if n.prefixes.test(idx) {
+		n.values[n.prefixes.rank(idx)] = val
+		return
+	}
+	rank := n.prefixes.rank(idx)
+	n.values = append(n.values, nil)
+	copy(n.values[rank+1:], n.values[rank:])
+	n.values[rank] = val
+	n.prefixes.set(idx)
+}
+
+func (n *tableNode) clearPrefix(idx int) {
+	rank := n.prefixes.rank(idx)
+	n.values = append(n.values[:rank], n.values[rank+1:]...)
+	n.prefixes.clear(idx)
+}
+
+// lookupStride finds the longest prefix of octet that terminates in
+// this stride, starting at the leaf slot (pfxLen 8) and halving the
+// index up towards the root (pfxLen 0) one bit at a time, so the first
+// hit is the longest match.
+func (n *tableNode) lookupStride(octet byte) (val interface{}, pfxLen uint8, ok bool) {
+	for idx, plen := 0x100|int(octet), uint8(8); idx > 0; idx, plen = idx>>1, plen-1 {
+		if n.prefixes.test(idx) {
+			return n.values[n.prefixes.rank(idx)], plen, true
+		}
+	}
+	return nil, 0, false
+}
+
+// IPTable is a BART-style (balanced routing table) longest-prefix-match
+// structure: the address is walked one byte ("stride") at a time instead
+// of bit by bit, so a lookup visits at most one node per address byte
+// (4 for IPv4, 16 for IPv6) instead of one per branching node of IPSet's
+// binary Patricia trie. Each stride node carries a 256-entry child array,
+// so it costs more memory per node than IPSet in exchange for fewer
+// pointer chases per lookup on BGP-sized tables (hundreds of thousands of
+// prefixes).
+type IPTable struct {
+	root4 *tableNode
+	root6 *tableNode
+	size  int
+}
+
+func NewTable() *IPTable {
+	return &IPTable{}
+}
+
+// walk descends from the family root along ip, one stride per byte,
+// stopping at the node holding the stride where the prefix of length
+// ones terminates. If create is true, missing stride nodes are
+// allocated along the way (for Insert); otherwise a missing node yields
+// ok == false (for Get/Delete).
+func (t *IPTable) walk(ip net.IP, ones int, create bool) (n *tableNode, idx int, ok bool) {
+	var root **tableNode
+	if v4 := ip.To4(); v4 != nil {
+		ip, root = v4, &t.root4
+	} else {
+		ip, root = ip.To16(), &t.root6
+	}
+
+	node := *root
+	if node == nil {
+		if !create {
+			return nil, 0, false
+		}
+		node = &tableNode{}
+		*root = node
+	}
+
+	remaining := ones
+	for i := 0; ; i++ {
+		if remaining <= 8 {
+			return node, baseIdx(ip[i], uint8(remaining)), true
+		}
+		remaining -= 8
+		next := node.child[ip[i]]
+		if next == nil {
+			if !create {
+				return nil, 0, false
+			}
+			next = &tableNode{}
+			node.child[ip[i]] = next
+		}
+		node = next
+	}
+}
+
+func (t *IPTable) Insert(cidr *net.IPNet, val interface{}) error {
+	ones, bitlen := cidr.Mask.Size()
+	if bitlen == 0 {
+		return ErrBadIP
+	}
+	if _, _, err := normalizeIP(cidr.IP, bitlen); err != nil {
+		return err
+	}
+	node, idx, _ := t.walk(cidr.IP, ones, true)
+	if !node.prefixes.test(idx) {
+		t.size++
+	}
+	node.setPrefix(idx, val)
+	return nil
+}
+
+func (t *IPTable) Delete(cidr *net.IPNet) error {
+	ones, bitlen := cidr.Mask.Size()
+	if bitlen == 0 {
+		return ErrBadIP
+	}
+	if _, _, err := normalizeIP(cidr.IP, bitlen); err != nil {
+		return err
+	}
+	node, idx, ok := t.walk(cidr.IP, ones, false)
+	if !ok || !node.prefixes.test(idx) {
+		return ErrNotFound
+	}
+	node.clearPrefix(idx)
+	t.size--
+	return nil
+}
+
+func (t *IPTable) Get(cidr *net.IPNet) (interface{}, error) {
+	ones, bitlen := cidr.Mask.Size()
+	if bitlen == 0 {
+		return nil, ErrBadIP
+	}
+	if _, _, err := normalizeIP(cidr.IP, bitlen); err != nil {
+		return nil, err
+	}
+	node, idx, ok := t.walk(cidr.IP, ones, false)
+	if !ok || !node.prefixes.test(idx) {
+		return nil, ErrNotFound
+	}
+	return node.values[node.prefixes.rank(idx)], nil
+}
+
+// LookupIP performs a longest-prefix-match lookup, checking every
+// stride it passes through for a terminating prefix and descending
+// into the matching child if one exists, so the deepest match found
+// along the path wins even if a longer route lives further down.
+func (t *IPTable) LookupIP(ip net.IP) (net.IPNet, interface{}, bool) {
+	var node *tableNode
+	var key net.IP
+	if v4 := ip.To4(); v4 != nil {
+		node, key = t.root4, v4
+	} else {
+		node, key = t.root6, ip.To16()
+	}
+	if node == nil {
+		return net.IPNet{}, nil, false
+	}
+
+	var bestVal interface{}
+	var bestLen int
+	found := false
+	for i := 0; i < len(key); i++ {
+		if val, plen, ok := node.lookupStride(key[i]); ok {
+			bestVal, bestLen, found = val, i*8+int(plen), true
+		}
+		child := node.child[key[i]]
+		if child == nil {
+			break
+		}
+		node = child
+	}
+	if !found {
+		return net.IPNet{}, nil, false
+	}
+
+	mask := net.CIDRMask(bestLen, len(key)*8)
+	resultIP := make(net.IP, len(key))
+	for i := range resultIP {
+		resultIP[i] = key[i] & mask[i]
+	}
+	return net.IPNet{IP: resultIP, Mask: mask}, bestVal, true
+}
+
+func (t *IPTable) Size() int {
+	return t.size
+}
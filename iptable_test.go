@@ -0,0 +1,136 @@
+package iputils
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestIPTableInsertGetDelete(t *testing.T) {
+	tbl := NewTable()
+	n8 := mustCIDR(t, "10.0.0.0/8")
+	n24 := mustCIDR(t, "10.0.1.0/24")
+
+	if err := tbl.Insert(n8, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Insert(n24, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tbl.Size(), 2; got != want {
+		t.Fatalf("Size() = %d, want %d", got, want)
+	}
+	if v, err := tbl.Get(n24); err != nil || v != "b" {
+		t.Fatalf("Get(10.0.1.0/24) = %v, %v", v, err)
+	}
+
+	if err := tbl.Delete(n24); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.Get(n24); err != ErrNotFound {
+		t.Fatalf("Get after Delete = %v, want ErrNotFound", err)
+	}
+	if v, err := tbl.Get(n8); err != nil || v != "a" {
+		t.Fatalf("Delete of a more-specific route disturbed 10.0.0.0/8: %v, %v", v, err)
+	}
+}
+
+func TestIPTable4in6(t *testing.T) {
+	tbl := NewTable()
+	n := &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}
+	if err := tbl.Insert(n, "v4"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tbl.Get(n); err != nil || v != "v4" {
+		t.Fatalf("Get(4-in-6 IPNet) = %v, %v", v, err)
+	}
+	ip, _, found := tbl.LookupIP(net.ParseIP("10.0.0.1"))
+	if !found || ip.String() != "10.0.0.0/24" {
+		t.Fatalf("LookupIP(10.0.0.1) = %v, %v", ip, found)
+	}
+}
+
+func TestIPTableLookupIPLongestMatch(t *testing.T) {
+	tbl := NewTable()
+	if err := tbl.Insert(mustCIDR(t, "10.0.0.0/8"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Insert(mustCIDR(t, "10.0.1.0/24"), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	net1, val, ok := tbl.LookupIP(net.ParseIP("10.0.1.5"))
+	if !ok || val != "b" || net1.String() != "10.0.1.0/24" {
+		t.Fatalf("LookupIP(10.0.1.5) = %v, %v, %v", net1, val, ok)
+	}
+	net2, val, ok := tbl.LookupIP(net.ParseIP("10.0.2.5"))
+	if !ok || val != "a" || net2.String() != "10.0.0.0/8" {
+		t.Fatalf("LookupIP(10.0.2.5) = %v, %v, %v", net2, val, ok)
+	}
+	if _, _, ok := tbl.LookupIP(net.ParseIP("192.168.0.1")); ok {
+		t.Fatalf("LookupIP(192.168.0.1) matched, want no route")
+	}
+}
+
+// randomPrefixes generates n pseudo-random, BGP-table-shaped IPv4 prefixes
+// (mostly /24s and /16s, like a real default-free-zone dump) for the
+// benchmarks below.
+func randomPrefixes(n int) []*net.IPNet {
+	r := rand.New(rand.NewSource(1))
+	lens := []int{16, 20, 24}
+	out := make([]*net.IPNet, n)
+	for i := range out {
+		ip := net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), 0).To4()
+		ones := lens[r.Intn(len(lens))]
+		mask := net.CIDRMask(ones, 32)
+		out[i] = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return out
+}
+
+func BenchmarkIPTableLookupIP(b *testing.B) {
+	prefixes := randomPrefixes(200000)
+	tbl := NewTable()
+	for i, p := range prefixes {
+		tbl.Insert(p, i)
+	}
+	ip := net.ParseIP("10.20.30.40")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tbl.LookupIP(ip)
+	}
+}
+
+func BenchmarkIPSetGetByIP(b *testing.B) {
+	prefixes := randomPrefixes(200000)
+	s := NewSet()
+	for i, p := range prefixes {
+		s.Add(p, i)
+	}
+	ip := net.ParseIP("10.20.30.40")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.GetByIP(ip)
+	}
+}
+
+func BenchmarkIPTableInsert(b *testing.B) {
+	prefixes := randomPrefixes(b.N)
+	tbl := NewTable()
+	b.ResetTimer()
+	for i, p := range prefixes {
+		tbl.Insert(p, i)
+	}
+}
+
+func BenchmarkIPSetAdd(b *testing.B) {
+	prefixes := randomPrefixes(b.N)
+	s := NewSet()
+	b.ResetTimer()
+	for i, p := range prefixes {
+		s.Add(p, i)
+	}
+}
+